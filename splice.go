@@ -172,6 +172,42 @@ func (b *bucket) Release() {
 	}
 }
 
+func teeBuffer(dsts []net.Conn, src net.Conn, len int64) (n int64, err error) {
+	bufferSize := maxSpliceSize
+	if bufferSize < int(len) {
+		bufferSize = int(len)
+	}
+	pool := assignPool(bufferSize)
+	buf := pool.Get().([]byte)
+	defer pool.Put(buf)
+	var remain int
+	remain, err = src.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	if remain == 0 {
+		return 0, EOF
+	}
+	n = int64(remain)
+	for _, dst := range dsts {
+		var out int
+		var pos int
+		left := remain
+		for left > 0 {
+			out, err = dst.Write(buf[pos : pos+left])
+			if out > 0 {
+				left -= out
+				pos += out
+				continue
+			}
+			if err != syscall.EAGAIN {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
 func spliceBuffer(dst, src net.Conn, len int64) (n int64, err error) {
 	bufferSize := maxSpliceSize
 	if bufferSize < int(len) {
@@ -205,3 +241,70 @@ func spliceBuffer(dst, src net.Conn, len int64) (n int64, err error) {
 	}
 	return n, nil
 }
+
+// closeWriter is implemented by connections, such as *net.TCPConn, that support half-closing
+// their write side.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Proxy runs a full-duplex copy between a and b, splicing each direction in its own
+// goroutine until EOF or an error, then half-closes the peer's write side when it supports
+// CloseWrite. It returns the byte counts transferred in each direction and the first
+// non-EOF error encountered in either direction.
+func Proxy(a, b net.Conn) (aToB, bToA int64, err error) {
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	setErr := func(e error) {
+		if e != nil {
+			errOnce.Do(func() { err = e })
+		}
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var aErr error
+		aToB, aErr = spliceUntilEOF(b, a)
+		setErr(aErr)
+		if cw, ok := b.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		var bErr error
+		bToA, bErr = spliceUntilEOF(a, b)
+		setErr(bErr)
+		if cw, ok := a.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}()
+	wg.Wait()
+	return aToB, bToA, err
+}
+
+// eagainBackoff is how long spliceUntilEOF sleeps after an EAGAIN before retrying, so an
+// idle direction of a Proxy doesn't spin a CPU core between bursts of traffic.
+const eagainBackoff = time.Millisecond
+
+// spliceUntilEOF repeatedly splices from src to dst until src reaches EOF or an error other
+// than EAGAIN occurs.
+func spliceUntilEOF(dst, src net.Conn) (total int64, err error) {
+	for {
+		var n int64
+		n, err = Splice(dst, src, maxSpliceSize)
+		total += n
+		if err == nil {
+			continue
+		}
+		if err == EOF {
+			return total, nil
+		}
+		if err == syscall.EAGAIN {
+			time.Sleep(eagainBackoff)
+			err = nil
+			continue
+		}
+		return total, err
+	}
+}
@@ -7,7 +7,13 @@ package splice
 
 import (
 	"errors"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -18,11 +24,74 @@ const (
 	// maxSpliceSize is the maximum amount of data Splice asks
 	// the kernel to move in a single call to splice(2).
 	maxSpliceSize = 4 << 20
+
+	// fcntl F_SETPIPE_SZ/F_GETPIPE_SZ, not exposed by the syscall package.
+	fSetPipeSz = 1031
+	fGetPipeSz = 1032
+
+	pipeMaxSizeFile = "/proc/sys/fs/pipe-max-size"
 )
 
 // ErrSyscallConn will be returned when the net.Conn do not implements the syscall.Conn interface.
 var ErrSyscallConn = errors.New("The net.Conn do not implements the syscall.Conn interface")
 
+// pipeCapacity is the desired pipe buffer size in bytes for newly created contexts; zero
+// leaves the kernel's default capacity in place.
+var pipeCapacity int32
+
+// SetPipeCapacity sets the kernel pipe buffer capacity requested for every splice context
+// created afterwards, via fcntl(writer, F_SETPIPE_SZ, bytes). bytes is rounded up to the
+// system page size and clamped to /proc/sys/fs/pipe-max-size when that file is readable.
+func SetPipeCapacity(bytes int) error {
+	if bytes <= 0 {
+		return errors.New("splice: pipe capacity must be positive")
+	}
+	pageSize := syscall.Getpagesize()
+	bytes = ((bytes + pageSize - 1) / pageSize) * pageSize
+	if max := readPipeMaxSize(); max > 0 && bytes > max {
+		bytes = max
+	}
+	atomic.StoreInt32(&pipeCapacity, int32(bytes))
+	return nil
+}
+
+func readPipeMaxSize() int {
+	data, err := ioutil.ReadFile(pipeMaxSizeFile)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// setPipeSize applies the fcntl(F_SETPIPE_SZ) request, falling back to the largest power of
+// two the kernel will accept when bytes is rejected with EPERM or EINVAL.
+func setPipeSize(fd int, bytes int) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(fSetPipeSz), uintptr(bytes))
+	if errno == 0 {
+		return nil
+	}
+	if errno != syscall.EPERM && errno != syscall.EINVAL {
+		return errno
+	}
+	pageSize := syscall.Getpagesize()
+	size := 1
+	for size*2 <= bytes {
+		size *= 2
+	}
+	for size >= pageSize {
+		_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(fSetPipeSz), uintptr(size))
+		if errno == 0 {
+			return nil
+		}
+		size /= 2
+	}
+	return errno
+}
+
 // newContext returns a new context.
 func newContext(b *bucket) (ctx *context, err error) {
 	var p [2]int
@@ -34,7 +103,13 @@ func newContext(b *bucket) (ctx *context, err error) {
 		ctx = &context{reader: int(p[0]), writer: int(p[1]), bucket: b}
 	}
 	syscall.ForkLock.RUnlock()
-	return ctx, err
+	if err != nil {
+		return nil, err
+	}
+	if capacity := atomic.LoadInt32(&pipeCapacity); capacity > 0 {
+		setPipeSize(ctx.writer, int(capacity))
+	}
+	return ctx, nil
 }
 
 // Close closes the context.
@@ -43,6 +118,22 @@ func (ctx *context) Close() {
 	syscall.Close(ctx.writer)
 }
 
+// Flags is a bitmask of splice(2) flags. The zero value requests no extra flags beyond the
+// non-blocking mode Splice and SpliceWithFlags always set.
+type Flags int
+
+const (
+	// FlagMove hints the kernel to move pages instead of copying them, SPLICE_F_MOVE.
+	FlagMove Flags = 0x01
+	// FlagNonblock makes the splice(2) call non-blocking, SPLICE_F_NONBLOCK.
+	FlagNonblock Flags = 0x02
+	// FlagMore hints more data will follow, SPLICE_F_MORE. Setting it on the pipe-to-socket
+	// half of a splice lets TCP coalesce writes, similar in effect to TCP_CORK.
+	FlagMore Flags = 0x04
+	// FlagGift lets the kernel take ownership of the user pages, SPLICE_F_GIFT.
+	FlagGift Flags = 0x08
+)
+
 // Splice wraps the splice system call.
 //
 // splice() moves data between two file descriptors without copying between
@@ -50,6 +141,12 @@ func (ctx *context) Close() {
 // of data from the file descriptor rfd to the file descriptor wfd,
 // where one of the descriptors must refer to a pipe.
 func Splice(dst, src net.Conn, len int64) (n int64, err error) {
+	return SpliceWithFlags(dst, src, len, 0)
+}
+
+// SpliceWithFlags behaves like Splice but additionally ORs flags into both splice(2) calls,
+// on top of the non-blocking mode it always sets.
+func SpliceWithFlags(dst, src net.Conn, len int64, flags Flags) (n int64, err error) {
 	var srcFd, dstFd int
 	dstFd, err = netFd(dst)
 	if err != nil {
@@ -73,10 +170,11 @@ func Splice(dst, src net.Conn, len int64) (n int64, err error) {
 	if len > maxSpliceSize {
 		len = maxSpliceSize
 	}
+	spliceFlags := spliceNonblock | int(flags)
 	var remain int64
 	// If remain == 0 && err == nil, src is at EOF, and the
 	// transfer is complete.
-	remain, err = splice(srcFd, nil, wFd, nil, int(len), spliceNonblock)
+	remain, err = splice(srcFd, nil, wFd, nil, int(len), spliceFlags)
 	if err != nil {
 		return 0, err
 	}
@@ -85,7 +183,7 @@ func Splice(dst, src net.Conn, len int64) (n int64, err error) {
 	}
 	var out int64
 	for remain > 0 {
-		out, err = splice(rFd, nil, dstFd, nil, int(remain), spliceNonblock)
+		out, err = splice(rFd, nil, dstFd, nil, int(remain), spliceFlags)
 		if out > 0 {
 			remain -= out
 			n += out
@@ -99,6 +197,348 @@ func Splice(dst, src net.Conn, len int64) (n int64, err error) {
 	return n, nil
 }
 
+// SpliceToFile copies up to n bytes from src into dst using splice(2) without a userspace
+// copy. It falls back to io.Copy when either descriptor cannot be obtained via syscall.Conn.
+func SpliceToFile(dst *os.File, src net.Conn, n int64) (written int64, err error) {
+	var srcFd, dstFd int
+	srcFd, err = netFd(src)
+	if err != nil {
+		return io.Copy(dst, io.LimitReader(src, n))
+	}
+	dstFd, err = fileFd(dst)
+	if err != nil {
+		return io.Copy(dst, io.LimitReader(src, n))
+	}
+	b := assignBucket(dstFd).GetInstance()
+	var ctx *context
+	ctx, err = b.Get()
+	if err != nil {
+		return io.Copy(dst, io.LimitReader(src, n))
+	}
+	defer b.Free(ctx)
+	ctx.alive = false
+	rFd := ctx.reader
+	wFd := ctx.writer
+	if n > maxSpliceSize {
+		n = maxSpliceSize
+	}
+	var remain int64
+	remain, err = splice(srcFd, nil, wFd, nil, int(n), spliceNonblock)
+	if err != nil {
+		return 0, err
+	}
+	if remain == 0 {
+		return 0, EOF
+	}
+	var out int64
+	for remain > 0 {
+		out, err = splice(rFd, nil, dstFd, nil, int(remain), spliceNonblock)
+		if out > 0 {
+			remain -= out
+			written += out
+			continue
+		}
+		if err != syscall.EAGAIN {
+			return written, EOF
+		}
+	}
+	ctx.alive = true
+	return written, nil
+}
+
+// copyFromFileAt is the io.Copy fallback for SpliceFromFile: it reads src at the offset
+// pointed to by off, via io.SectionReader/ReadAt rather than src's file position, and
+// advances *off by the number of bytes copied. A nil off copies from src's current position.
+func copyFromFileAt(dst net.Conn, src *os.File, off *int64, n int64) (int64, error) {
+	if off == nil {
+		return io.Copy(dst, io.LimitReader(src, n))
+	}
+	written, err := io.Copy(dst, io.NewSectionReader(src, *off, n))
+	*off += written
+	return written, err
+}
+
+// SpliceFromFile copies up to n bytes from src into dst using splice(2) without a userspace
+// copy, reading src starting at the offset pointed to by off instead of src's file position.
+// off is advanced by the transferred byte count on success and left untouched on EAGAIN,
+// matching the splice(2) kernel contract. A nil off reads from src's current position. It
+// falls back to copyFromFileAt when either descriptor cannot be obtained via syscall.Conn.
+func SpliceFromFile(dst net.Conn, src *os.File, off *int64, n int64) (written int64, err error) {
+	var srcFd, dstFd int
+	srcFd, err = fileFd(src)
+	if err != nil {
+		return copyFromFileAt(dst, src, off, n)
+	}
+	dstFd, err = netFd(dst)
+	if err != nil {
+		return copyFromFileAt(dst, src, off, n)
+	}
+	b := assignBucket(dstFd).GetInstance()
+	var ctx *context
+	ctx, err = b.Get()
+	if err != nil {
+		return copyFromFileAt(dst, src, off, n)
+	}
+	defer b.Free(ctx)
+	ctx.alive = false
+	rFd := ctx.reader
+	wFd := ctx.writer
+	if n > maxSpliceSize {
+		n = maxSpliceSize
+	}
+	var remain int64
+	remain, err = splice(srcFd, off, wFd, nil, int(n), spliceNonblock)
+	if err != nil {
+		return 0, err
+	}
+	if remain == 0 {
+		return 0, EOF
+	}
+	var out int64
+	for remain > 0 {
+		out, err = splice(rFd, nil, dstFd, nil, int(remain), spliceNonblock)
+		if out > 0 {
+			remain -= out
+			written += out
+			continue
+		}
+		if err != syscall.EAGAIN {
+			return written, EOF
+		}
+	}
+	ctx.alive = true
+	return written, nil
+}
+
+// getPipeSize returns fd's current pipe buffer size via fcntl(F_GETPIPE_SZ), or a
+// conservative default if the kernel call fails.
+func getPipeSize(fd int) int {
+	size, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(fGetPipeSz), 0)
+	if errno != 0 {
+		return 64 << 10
+	}
+	return int(size)
+}
+
+// Tee fans up to n bytes read from src into dsts without a userspace copy, returning the
+// number of bytes transferred from src. tee(2) never consumes its source, so bytes sitting
+// in the primary pipe must be duplicated into one secondary pipe per destination after
+// dsts[0] *before* the primary pipe is ever drained to dsts[0] — otherwise a second tee(2)
+// call meant to continue a short tee would just re-duplicate the same front-of-pipe bytes
+// instead of the next chunk. To guarantee every tee(2) call fully succeeds in one pass, each
+// round moves at most the smallest pipe capacity among the primary and secondary pipes, all
+// of which are empty at the start of a round. It falls back to a shared-buffer copy when any
+// destination's fd cannot be obtained.
+func Tee(dsts []net.Conn, src net.Conn, n int64) (total int64, err error) {
+	if len(dsts) == 0 {
+		return 0, nil
+	}
+	if len(dsts) == 1 {
+		return Splice(dsts[0], src, n)
+	}
+	var srcFd int
+	srcFd, err = netFd(src)
+	if err != nil {
+		return teeBuffer(dsts, src, n)
+	}
+	dstFds := make([]int, len(dsts))
+	for i, dst := range dsts {
+		dstFds[i], err = netFd(dst)
+		if err != nil {
+			return teeBuffer(dsts, src, n)
+		}
+	}
+	primary := assignBucket(dstFds[0]).GetInstance()
+	var pctx *context
+	pctx, err = primary.Get()
+	if err != nil {
+		return teeBuffer(dsts, src, n)
+	}
+	defer primary.Free(pctx)
+	pctx.alive = false
+
+	secondaryBuckets := make([]*bucket, len(dstFds)-1)
+	secondaries := make([]*context, len(dstFds)-1)
+	for i := range secondaries {
+		sb := assignBucket(dstFds[0] + 1 + i).GetInstance()
+		var sctx *context
+		sctx, err = sb.Get()
+		if err != nil {
+			return teeBuffer(dsts, src, n)
+		}
+		sctx.alive = false
+		secondaryBuckets[i] = sb
+		secondaries[i] = sctx
+	}
+	defer func() {
+		for i, sb := range secondaryBuckets {
+			sb.Free(secondaries[i])
+		}
+	}()
+
+	if n > maxSpliceSize {
+		n = maxSpliceSize
+	}
+	var remain int64
+	remain, err = splice(srcFd, nil, pctx.writer, nil, int(n), spliceNonblock)
+	if err != nil {
+		return 0, err
+	}
+	if remain == 0 {
+		return 0, EOF
+	}
+
+	chunkSize := getPipeSize(pctx.writer)
+	for _, sctx := range secondaries {
+		if c := getPipeSize(sctx.writer); c < chunkSize {
+			chunkSize = c
+		}
+	}
+
+	var out int64
+	for remain > 0 {
+		chunk := remain
+		if chunk > int64(chunkSize) {
+			chunk = int64(chunkSize)
+		}
+		for i, sctx := range secondaries {
+			var teed int64
+			for {
+				teed, err = syscall.Tee(pctx.reader, sctx.writer, int(chunk), spliceNonblock)
+				if teed > 0 {
+					break
+				}
+				if err == syscall.EAGAIN {
+					continue
+				}
+				if err == nil {
+					return total, EOF
+				}
+				return total, err
+			}
+			left := teed
+			for left > 0 {
+				out, err = splice(sctx.reader, nil, dstFds[i+1], nil, int(left), spliceNonblock)
+				if out > 0 {
+					left -= out
+					continue
+				}
+				if err != syscall.EAGAIN {
+					return total, EOF
+				}
+			}
+		}
+		chunkRemain := chunk
+		for chunkRemain > 0 {
+			out, err = splice(pctx.reader, nil, dstFds[0], nil, int(chunkRemain), spliceNonblock)
+			if out > 0 {
+				chunkRemain -= out
+				total += out
+				continue
+			}
+			if err != syscall.EAGAIN {
+				return total, EOF
+			}
+		}
+		remain -= chunk
+	}
+	pctx.alive = true
+	for _, sctx := range secondaries {
+		sctx.alive = true
+	}
+	return total, nil
+}
+
+// SpliceAt copies up to n bytes from src into dst using splice(2), reading src starting at
+// the file offset off instead of src's current file position. It is a convenience wrapper
+// around SpliceFromFile for callers who want a one-shot, offset-based read without tracking
+// the advanced offset themselves.
+func SpliceAt(dst net.Conn, src *os.File, off int64, n int64) (int64, error) {
+	o := off
+	return SpliceFromFile(dst, src, &o, n)
+}
+
+// copyToFileAt is the io.Copy fallback for SpliceRangeTo: it writes dst at the given file
+// offset via WriteAt rather than dst's current file position, leaving that position unchanged.
+func copyToFileAt(dst *os.File, src net.Conn, off int64, n int64) (int64, error) {
+	r := io.LimitReader(src, n)
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		nr, er := r.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.WriteAt(buf[:nr], off+written)
+			if nw > 0 {
+				written += int64(nw)
+			}
+			if ew != nil {
+				return written, ew
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				return written, nil
+			}
+			return written, er
+		}
+	}
+}
+
+// SpliceRangeTo copies up to n bytes from src into dst using splice(2), writing dst starting
+// at the file offset off instead of dst's current file position, leaving that position
+// unchanged. It is the write-side counterpart to SpliceAt. It falls back to copyToFileAt when
+// either descriptor cannot be obtained via syscall.Conn.
+func SpliceRangeTo(dst *os.File, src net.Conn, off int64, n int64) (written int64, err error) {
+	var srcFd, dstFd int
+	srcFd, err = netFd(src)
+	if err != nil {
+		return copyToFileAt(dst, src, off, n)
+	}
+	dstFd, err = fileFd(dst)
+	if err != nil {
+		return copyToFileAt(dst, src, off, n)
+	}
+	b := assignBucket(dstFd).GetInstance()
+	var ctx *context
+	ctx, err = b.Get()
+	if err != nil {
+		return copyToFileAt(dst, src, off, n)
+	}
+	defer b.Free(ctx)
+	ctx.alive = false
+	rFd := ctx.reader
+	wFd := ctx.writer
+	if n > maxSpliceSize {
+		n = maxSpliceSize
+	}
+	var remain int64
+	remain, err = splice(srcFd, nil, wFd, nil, int(n), spliceNonblock)
+	if err != nil {
+		return 0, err
+	}
+	if remain == 0 {
+		return 0, EOF
+	}
+	woff := off
+	var out int64
+	for remain > 0 {
+		out, err = splice(rFd, nil, dstFd, &woff, int(remain), spliceNonblock)
+		if out > 0 {
+			remain -= out
+			written += out
+			continue
+		}
+		if err != syscall.EAGAIN {
+			return written, EOF
+		}
+	}
+	ctx.alive = true
+	return written, nil
+}
+
 func netFd(conn net.Conn) (int, error) {
 	syscallConn, ok := conn.(syscall.Conn)
 	if !ok {
@@ -107,6 +547,10 @@ func netFd(conn net.Conn) (int, error) {
 	return fd(syscallConn)
 }
 
+func fileFd(f *os.File) (int, error) {
+	return fd(f)
+}
+
 func fd(c syscall.Conn) (int, error) {
 	var nfd int
 	raw, err := c.SyscallConn()
@@ -0,0 +1,431 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+// +build linux
+
+package splice
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSpliceToFile(t *testing.T) {
+	addr := "127.0.0.1:8881"
+	contents := "Hello file"
+	f, err := ioutil.TempFile("", "splice-to-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	wg := sync.WaitGroup{}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		time.Sleep(time.Millisecond * 100)
+		written, err := SpliceToFile(f, conn, int64(len(contents)))
+		if err != nil && err != syscall.EAGAIN && err != EOF {
+			t.Error(err)
+		}
+		if int(written) != len(contents) {
+			t.Errorf("written=%d want=%d", written, len(contents))
+		}
+	}()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(contents))
+	conn.Close()
+	wg.Wait()
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != contents {
+		t.Errorf("contents not transmitted: got %s, want %s", string(b), contents)
+	}
+}
+
+func TestSpliceFromFile(t *testing.T) {
+	addr := "127.0.0.1:8882"
+	contents := "Hello socket"
+	f, err := ioutil.TempFile("", "splice-from-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	wg := sync.WaitGroup{}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	var received []byte
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		received, err = ioutil.ReadAll(conn)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var off int64
+	written, err := SpliceFromFile(conn, f, &off, int64(len(contents)))
+	conn.Close()
+	if err != nil && err != syscall.EAGAIN && err != EOF {
+		t.Error(err)
+	}
+	if int(written) != len(contents) {
+		t.Errorf("written=%d want=%d", written, len(contents))
+	}
+	if off != int64(len(contents)) {
+		t.Errorf("off not advanced: got %d, want %d", off, len(contents))
+	}
+	wg.Wait()
+	time.Sleep(time.Millisecond * 100)
+	if string(received) != contents {
+		t.Errorf("contents not transmitted: got %s, want %s", string(received), contents)
+	}
+}
+
+func TestSpliceWithFlags(t *testing.T) {
+	addr := "127.0.0.1:8885"
+	proxyAddr := "127.0.0.1:9995"
+	contents := "Hello flags"
+	wg := sync.WaitGroup{}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Error(err)
+	}
+	defer lis.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		if string(b) != contents {
+			t.Errorf("contents not transmitted: got %s (len=%d), want %s\n", string(b), len(b), contents)
+		}
+	}()
+
+	plis, err := net.Listen("tcp", proxyAddr)
+	if err != nil {
+		t.Error(err)
+	}
+	defer plis.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Wait()
+		defer wg.Done()
+		conn, err := plis.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		defer conn.Close()
+		proxy, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+		}
+		defer proxy.Close()
+		time.Sleep(time.Millisecond * 100)
+		written, err := SpliceWithFlags(proxy, conn, 1024, FlagMore)
+		if err != nil && err != syscall.EAGAIN && err != EOF {
+			t.Error(err)
+		}
+		if int(written) != len(contents) {
+			t.Error()
+		}
+	}()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Error(err)
+	}
+	conn.Write([]byte(contents))
+	conn.Close()
+	wg.Wait()
+}
+
+func TestSetPipeCapacity(t *testing.T) {
+	capacity := 1 << 20
+	if err := SetPipeCapacity(capacity); err != nil {
+		t.Error(err)
+	}
+	defer SetPipeCapacity(64 << 10)
+	b := assignBucket(0).GetInstance()
+	// Drop any pooled context created before SetPipeCapacity, so Get returns one whose
+	// pipe was just sized by newContext.
+	b.Release()
+	ctx, err := b.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(ctx.writer), uintptr(fGetPipeSz), 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if int(size) < capacity {
+		t.Errorf("pipe size=%d want at least %d", size, capacity)
+	}
+	ctx.alive = true
+	b.Free(ctx)
+	if err := SetPipeCapacity(0); err == nil {
+		t.Error("expected error for non-positive capacity")
+	}
+}
+
+func TestSpliceAt(t *testing.T) {
+	addr := "127.0.0.1:8883"
+	prefix := "skip me, "
+	contents := "Hello range"
+	f, err := ioutil.TempFile("", "splice-at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(prefix + contents); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	wg := sync.WaitGroup{}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	var received []byte
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		received, err = ioutil.ReadAll(conn)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := SpliceAt(conn, f, int64(len(prefix)), int64(len(contents)))
+	conn.Close()
+	if err != nil && err != syscall.EAGAIN && err != EOF {
+		t.Error(err)
+	}
+	if int(written) != len(contents) {
+		t.Errorf("written=%d want=%d", written, len(contents))
+	}
+	wg.Wait()
+	time.Sleep(time.Millisecond * 100)
+	if string(received) != contents {
+		t.Errorf("contents not transmitted: got %s, want %s", string(received), contents)
+	}
+}
+
+func TestSpliceRangeTo(t *testing.T) {
+	addr := "127.0.0.1:8884"
+	contents := "Hello range"
+	f, err := ioutil.TempFile("", "splice-range-to")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	off := int64(4)
+	wg := sync.WaitGroup{}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		time.Sleep(time.Millisecond * 100)
+		written, err := SpliceRangeTo(f, conn, off, int64(len(contents)))
+		if err != nil && err != syscall.EAGAIN && err != EOF {
+			t.Error(err)
+		}
+		if int(written) != len(contents) {
+			t.Errorf("written=%d want=%d", written, len(contents))
+		}
+	}()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(contents))
+	conn.Close()
+	wg.Wait()
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[off:]) != contents {
+		t.Errorf("contents not transmitted at offset: got %s, want %s", string(b[off:]), contents)
+	}
+}
+
+// TestTeeMultiRound exercises Tee with a payload larger than a single pipe's capacity, so the
+// transfer takes several Tee calls, each of which fills the primary pipe at most to its
+// capacity. It checks that both destinations receive every byte once and in order, which a
+// loop that re-tees the front of the primary pipe would break, since tee(2) never consumes
+// its source pipe.
+func TestTeeMultiRound(t *testing.T) {
+	addr := "127.0.0.1:8892"
+	mirrorAddr := "127.0.0.1:8893"
+	proxyAddr := "127.0.0.1:9991"
+	contents := make([]byte, 200000)
+	for i := range contents {
+		contents[i] = byte(i)
+	}
+	wg := sync.WaitGroup{}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	var received []byte
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		received, err = ioutil.ReadAll(conn)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	mirrorLis, err := net.Listen("tcp", mirrorAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mirrorLis.Close()
+	var mirrored []byte
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := mirrorLis.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		mirrored, err = ioutil.ReadAll(conn)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	plis, err := net.Listen("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plis.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Wait()
+		defer wg.Done()
+		conn, err := plis.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		dst, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer dst.Close()
+		mirror, err := net.Dial("tcp", mirrorAddr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer mirror.Close()
+		var written int64
+		for written < int64(len(contents)) {
+			n, err := Tee([]net.Conn{dst, mirror}, conn, int64(len(contents))-written)
+			written += n
+			if err == EOF {
+				break
+			}
+			if err != nil && err != syscall.EAGAIN {
+				t.Error(err)
+				return
+			}
+		}
+		if int(written) != len(contents) {
+			t.Errorf("written=%d want=%d", written, len(contents))
+		}
+	}()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(contents)
+	conn.Close()
+	wg.Wait()
+	if !bytes.Equal(received, contents) {
+		t.Errorf("contents not transmitted correctly: len=%d want=%d", len(received), len(contents))
+	}
+	if !bytes.Equal(mirrored, contents) {
+		t.Errorf("contents not mirrored correctly: len=%d want=%d", len(mirrored), len(contents))
+	}
+}
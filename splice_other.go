@@ -36,3 +36,9 @@ func (ctx *context) Close() {
 func Splice(dst, src net.Conn, len int64) (n int64, err error) {
 	return spliceBuffer(dst, src, len)
 }
+
+// Tee fans up to n bytes read from src into dsts. Platforms without splice(2)/tee(2) support
+// fall back to a shared buffer, writing the same bytes to each destination in turn.
+func Tee(dsts []net.Conn, src net.Conn, n int64) (int64, error) {
+	return teeBuffer(dsts, src, n)
+}
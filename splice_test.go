@@ -140,11 +140,162 @@ func TestSpliceBuffer(t *testing.T) {
 	wg.Wait()
 }
 
-func TestBucket(t *testing.T) {
-	if contexts(maxContexts/maxContextsPerBucket) < 0 {
-		t.Error()
+func TestTee(t *testing.T) {
+	addr := "127.0.0.1:8890"
+	mirrorAddr := "127.0.0.1:8891"
+	proxyAddr := "127.0.0.1:9990"
+	contents := "Hello world"
+	wg := sync.WaitGroup{}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Error(err)
+	}
+	defer lis.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		if string(b) != contents {
+			t.Errorf("contents not transmitted: got %s (len=%d), want %s\n", string(b), len(b), contents)
+		}
+	}()
+
+	mirrorLis, err := net.Listen("tcp", mirrorAddr)
+	if err != nil {
+		t.Error(err)
 	}
-	MaxIdleContextsPerBucket(maxIdleContexts)
+	defer mirrorLis.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := mirrorLis.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		if string(b) != contents {
+			t.Errorf("contents not mirrored: got %s (len=%d), want %s\n", string(b), len(b), contents)
+		}
+	}()
+
+	plis, err := net.Listen("tcp", proxyAddr)
+	if err != nil {
+		t.Error(err)
+	}
+	defer plis.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Wait()
+		defer wg.Done()
+		conn, err := plis.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		defer conn.Close()
+		dst, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+		}
+		defer dst.Close()
+		mirror, err := net.Dial("tcp", mirrorAddr)
+		if err != nil {
+			t.Error(err)
+		}
+		defer mirror.Close()
+		time.Sleep(time.Millisecond * 100)
+		written, err := Tee([]net.Conn{dst, mirror}, conn, 1024)
+		if err != nil && err != syscall.EAGAIN && err != EOF {
+			t.Error(err)
+		}
+		if int(written) != len(contents) {
+			t.Error()
+		}
+	}()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Error(err)
+	}
+	conn.Write([]byte(contents))
+	conn.Close()
+	wg.Wait()
+}
+
+func TestProxy(t *testing.T) {
+	addr := "127.0.0.1:8895"
+	proxyAddr := "127.0.0.1:9996"
+	upContents := "Hello server"
+	downContents := "Hello client"
+	wg := sync.WaitGroup{}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Error(err)
+	}
+	defer lis.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		if string(b) != upContents {
+			t.Errorf("contents not transmitted: got %s (len=%d), want %s\n", string(b), len(b), upContents)
+		}
+		conn.Write([]byte(downContents))
+	}()
+
+	plis, err := net.Listen("tcp", proxyAddr)
+	if err != nil {
+		t.Error(err)
+	}
+	defer plis.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := plis.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		defer conn.Close()
+		proxy, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+		}
+		defer proxy.Close()
+		aToB, bToA, err := Proxy(conn, proxy)
+		if err != nil && err != syscall.EAGAIN && err != EOF {
+			t.Error(err)
+		}
+		if int(aToB) != len(upContents) {
+			t.Errorf("aToB=%d want=%d", aToB, len(upContents))
+		}
+		if int(bToA) != len(downContents) {
+			t.Errorf("bToA=%d want=%d", bToA, len(downContents))
+		}
+	}()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Error(err)
+	}
+	conn.Write([]byte(upContents))
+	conn.(*net.TCPConn).CloseWrite()
+	b, _ := ioutil.ReadAll(conn)
+	if string(b) != downContents {
+		t.Errorf("contents not proxied back: got %s, want %s", string(b), downContents)
+	}
+	conn.Close()
+	wg.Wait()
+}
+
+func TestBucket(t *testing.T) {
 	var ctxs = make([]*context, maxIdleContexts+1)
 	for i := 0; i < len(ctxs); i++ {
 		ctx, err := assignBucket(0).GetInstance().Get()